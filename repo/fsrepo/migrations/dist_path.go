@@ -0,0 +1,39 @@
+package migrations
+
+import "os"
+
+// distPathEnvVar names the environment variable that overrides the
+// distribution path used to fetch migrations, letting operators point at
+// their own gateway or mirror without patching code.
+const distPathEnvVar = "IPFS_DIST_PATH"
+
+// CurrentIpfsDist is the ipfs path under which this release's migration
+// distributions are rooted.  It is the default used for ipfsDistPath.
+//
+// This is the long-standing IPNS name for the distribution site, not a
+// pinned /ipfs/ CID: resolving it can return different content over time.
+// Code that needs to verify a fetched archive against a fixed CID (see
+// VerifiedHttpFetcher) does not derive its expectations from this path at
+// all, and keys its own CID map by dist/version/archive-name instead.
+const CurrentIpfsDist = "/ipns/dist.ipfs.io"
+
+// ipfsDistPath is the ipfs path under which migration distributions are
+// rooted.  It defaults to CurrentIpfsDist, as overridden by the
+// IPFS_DIST_PATH environment variable, and can be changed at runtime with
+// SetIpfsDistPath.
+var ipfsDistPath = GetDistPathEnv(CurrentIpfsDist)
+
+// SetIpfsDistPath sets the ipfs path under which migration distributions
+// are rooted, overriding any previous value or environment override.
+func SetIpfsDistPath(path string) {
+	ipfsDistPath = path
+}
+
+// GetDistPathEnv returns the value of the IPFS_DIST_PATH environment
+// variable, or def if that variable is not set.
+func GetDistPathEnv(def string) string {
+	if path := os.Getenv(distPathEnvVar); path != "" {
+		return path
+	}
+	return def
+}
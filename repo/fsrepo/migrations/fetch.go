@@ -8,16 +8,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
-
-	api "github.com/ipfs/go-ipfs-api"
 )
 
 const (
@@ -48,12 +45,26 @@ type limitReadCloser struct {
 // is needed because the archive "go-ipfs_v0.7.0_linux-amd64.tar.gz" contains a
 // binary named "ipfs"
 //
-//     FetchBinary(ctx, "go-ipfs", "v0.7.0", "go-ipfs", "ipfs", tmpDir)
+//     FetchBinary(ctx, fetcher, "go-ipfs", "v0.7.0", "go-ipfs", "ipfs", tmpDir, VerifyOptions{}, nil)
 //
 // If out is a directory, then the binary is written to that directory with the
 // same name it has inside the archive.  Otherwise, the binary file it written
 // to the file at out.
-func FetchBinary(ctx context.Context, dist, ver, arcName, binName, out string) (string, error) {
+//
+// The fetcher is used to retrieve the archive, and is not closed by
+// FetchBinary; the caller remains responsible for closing it.  If progress
+// is non-nil, it is registered on fetcher for the duration of the download;
+// see Fetcher.SetProgress.
+//
+// Before the archive is unpacked, it is checked against verifyOpts; see
+// VerifyOptions.  The archive is not unpacked, and the binary at out is not
+// created, unless verification succeeds.
+func FetchBinary(ctx context.Context, fetcher Fetcher, dist, ver, arcName, binName, out string, verifyOpts VerifyOptions, progress Progress) (string, error) {
+	if progress != nil {
+		fetcher.SetProgress(progress)
+		defer fetcher.SetProgress(nil)
+	}
+
 	// If archive base name not specified, then it is same as dist.
 	if arcName == "" {
 		arcName = dist
@@ -84,13 +95,6 @@ func FetchBinary(ctx context.Context, dist, ver, arcName, binName, out string) (
 		out = path.Join(out, binName)
 	}
 
-	// Create temp directory to store download
-	tmpDir, err := ioutil.TempDir("", arcName)
-	if err != nil {
-		return "", err
-	}
-	defer os.RemoveAll(tmpDir)
-
 	atype := "tar.gz"
 	if runtime.GOOS == "windows" {
 		atype = "zip"
@@ -99,30 +103,68 @@ func FetchBinary(ctx context.Context, dist, ver, arcName, binName, out string) (
 	arcName = makeArchiveName(arcName, ver, atype)
 	arcIpfsPath := makeIpfsPath(dist, ver, arcName)
 
-	// Create a file to write the archive data to
-	arcPath := path.Join(tmpDir, arcName)
-	arcFile, err := os.Create(arcPath)
+	// Download to a stable, deterministic path, under a private directory
+	// derived from out's own location, rather than a fresh randomized
+	// directory under the shared system temp dir.  This lets a partial
+	// download left behind by a transient failure be resumed by a later
+	// call instead of starting over, without handing another user on a
+	// shared host a predictable path to race or pre-plant.
+	arcPath, err := downloadCachePath(out, arcName)
 	if err != nil {
 		return "", err
 	}
-	defer arcFile.Close()
 
-	// Open connection to download archive from ipfs path
-	rc, err := fetch(ctx, arcIpfsPath)
+	// Serialize concurrent downloads of the same archive: two FetchBinary
+	// calls racing on the same arcPath could otherwise interleave writes
+	// or have one unpack bytes the other is still verifying.
+	unlock, err := lockDownload(ctx, arcPath)
 	if err != nil {
 		return "", err
 	}
-	defer rc.Close()
+	defer unlock()
 
-	// Write download data
-	_, err = io.Copy(arcFile, rc)
+	// Open (not create-and-truncate) so that any bytes already on disk
+	// from a previous, interrupted download are kept for the fetcher to
+	// resume from.
+	arcFile, err := os.OpenFile(arcPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
 		return "", err
 	}
+
+	// Download archive from ipfs path using the given fetcher
+	err = fetcher.Fetch(ctx, arcIpfsPath, arcFile)
 	arcFile.Close()
+	if err != nil {
+		var transient *TransientError
+		if !errors.As(err, &transient) {
+			os.Remove(arcPath)
+		}
+		return "", err
+	}
+
+	// Verify the archive's checksum and signature before trusting its
+	// contents enough to unpack them.  A verification failure is not
+	// transient: the downloaded bytes are wrong, so there is nothing to
+	// resume from.
+	verified, err := verifyArchive(ctx, fetcher, arcIpfsPath, arcPath, verifyOpts)
+	if err != nil {
+		os.Remove(arcPath)
+		return "", err
+	}
+
+	// Re-read arcPath immediately before trusting it to unpackArchive,
+	// and compare against the exact bytes just verified, rather than
+	// trusting that the path still names the same content across the
+	// two separate reads.
+	onDisk, err := ioutil.ReadFile(arcPath)
+	if err != nil || !bytes.Equal(onDisk, verified) {
+		os.Remove(arcPath)
+		return "", fmt.Errorf("archive at %s changed after verification; refusing to unpack", arcPath)
+	}
 
 	// Unpack the archive and write binary to out
 	err = unpackArchive(arcPath, atype, dist, binName, out)
+	os.Remove(arcPath)
 	if err != nil {
 		return "", err
 	}
@@ -136,69 +178,86 @@ func FetchBinary(ctx context.Context, dist, ver, arcName, binName, out string) (
 	return out, nil
 }
 
-// fetch attempts to fetch the file at the given ipfs path, first using the
-// local ipfs api if available, then using http.  Returns io.ReadCloser on
-// success, which caller must close.
-func fetch(ctx context.Context, ipfsPath string) (io.ReadCloser, error) {
-	// Check if local ipfs api if available
-	rc, err := ipfsFetch(ctx, ipfsPath)
-	if err == nil {
-		log.Print("using local ipfs daemon for transfer")
-		return rc, nil
-	}
-	// Try fetching via HTTP
-	return httpFetch(ctx, gatewayURL+ipfsPath)
-}
-
-// ipfsFetch attempts to fetch the file at the given ipfs path using the local
-// ipfs api.  Returns io.ReadCloser on success, which caller must close.
-func ipfsFetch(ctx context.Context, ipfsPath string) (io.ReadCloser, error) {
-	apiEp, err := ApiEndpoint("")
-	if err != nil {
-		return nil, err
-	}
-	sh := api.NewShell(apiEp)
-	sh.SetTimeout(shellTimeOut)
-	if !sh.IsUp() {
-		return nil, errors.New("ipfs api shell not up")
-	}
+// downloadCacheDirName is the private, per-destination directory that
+// downloadCachePath stores partial and verified downloads under.
+const downloadCacheDirName = ".ipfs-migrations-cache"
 
-	resp, err := sh.Request("cat", ipfsPath).Send(ctx)
-	if err != nil {
-		return nil, err
-	}
-	if resp.Error != nil {
-		return nil, resp.Error
+// downloadCachePath returns the stable path that FetchBinary downloads
+// arcName to.  Every call for the same out and arcName returns the same
+// path, so a partial download left behind by a transient failure is found
+// and resumed by a later call instead of starting over in a fresh
+// randomized temp directory.
+//
+// The cache directory is created, 0700, inside out's own parent
+// directory, alongside out itself, rather than under the shared, world-writable system temp
+// directory: deriving it from a location the caller already controls
+// means another user on a multi-user host has no predictable path to
+// pre-create, symlink, or otherwise tamper with ahead of the download. If
+// the directory already exists, it is rejected unless it is a real,
+// private (not group/other accessible) directory, guarding against a
+// directory or symlink planted there before this call.
+func downloadCachePath(out, arcName string) (string, error) {
+	dir := filepath.Join(filepath.Dir(out), downloadCacheDirName)
+
+	fi, err := os.Lstat(dir)
+	switch {
+	case os.IsNotExist(err):
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return "", err
+		}
+	case err != nil:
+		return "", err
+	default:
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to use download cache dir %s: it is a symlink", dir)
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("refusing to use download cache dir %s: not a directory", dir)
+		}
+		if fi.Mode().Perm()&0077 != 0 {
+			return "", fmt.Errorf("refusing to use download cache dir %s: accessible to other users (mode %o)", dir, fi.Mode().Perm())
+		}
 	}
 
-	return newLimitReadCloser(resp.Output, fetchSizeLimit), nil
+	return filepath.Join(dir, arcName), nil
 }
 
-// httpFetch attempts to fetch the file at the given URL.  Returns
-// io.ReadCloser on success, which caller must close.
-func httpFetch(ctx context.Context, url string) (io.ReadCloser, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("http.NewRequest error: %s", err)
-	}
-
-	req.Header.Set("User-Agent", "go-ipfs")
+// staleLockAge is how long a lock file may exist before lockDownload
+// assumes its owner is gone (killed, crashed) rather than still working,
+// and reclaims it rather than waiting on it forever.
+const staleLockAge = 10 * time.Minute
+
+// lockDownload acquires an exclusive, advisory lock on arcPath, blocking
+// until any other FetchBinary call downloading the same arcPath has
+// released it, so that two concurrent calls for the same archive cannot
+// race on writing, verifying, or unpacking the same file. A lock left
+// behind by a process that died without releasing it is reclaimed once it
+// is older than staleLockAge, rather than blocking every future call on
+// it forever. The returned func releases the lock and must be called when
+// the caller is done with arcPath.
+func lockDownload(ctx context.Context, arcPath string) (func(), error) {
+	lockPath := arcPath + ".lock"
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("http.DefaultClient.Do error: %s", err)
-	}
+		if fi, statErr := os.Stat(lockPath); statErr == nil && time.Since(fi.ModTime()) > staleLockAge {
+			os.Remove(lockPath)
+			continue
+		}
 
-	if resp.StatusCode >= 400 {
-		defer resp.Body.Close()
-		mes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("error reading error body: %s", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
 		}
-		return nil, fmt.Errorf("GET %s error: %s: %s", url, resp.Status, string(mes))
 	}
-
-	return newLimitReadCloser(resp.Body, fetchSizeLimit), nil
 }
 
 func newLimitReadCloser(rc io.ReadCloser, limit int64) io.ReadCloser {
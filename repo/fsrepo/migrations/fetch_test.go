@@ -0,0 +1,118 @@
+package migrations
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadCachePathIsStableAndPrivate(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "ipfs")
+
+	p1, err := downloadCachePath(out, "archive.tar.gz")
+	if err != nil {
+		t.Fatalf("downloadCachePath failed: %s", err)
+	}
+	p2, err := downloadCachePath(out, "archive.tar.gz")
+	if err != nil {
+		t.Fatalf("downloadCachePath failed on second call: %s", err)
+	}
+	if p1 != p2 {
+		t.Fatalf("expected the same path for repeated calls, got %q and %q", p1, p2)
+	}
+
+	fi, err := os.Stat(filepath.Dir(p1))
+	if err != nil {
+		t.Fatalf("expected cache dir to exist: %s", err)
+	}
+	if fi.Mode().Perm()&0077 != 0 {
+		t.Fatalf("expected cache dir to be private, got mode %o", fi.Mode().Perm())
+	}
+}
+
+func TestDownloadCachePathCreatesMissingParents(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "nested", "does", "not", "exist", "ipfs")
+
+	if _, err := downloadCachePath(out, "archive.tar.gz"); err != nil {
+		t.Fatalf("expected downloadCachePath to create missing parent directories, got %s", err)
+	}
+}
+
+func TestDownloadCachePathRejectsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "ipfs")
+
+	target := filepath.Join(dir, "elsewhere")
+	if err := os.Mkdir(target, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, downloadCacheDirName)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := downloadCachePath(out, "archive.tar.gz"); err == nil {
+		t.Fatal("expected downloadCachePath to reject a pre-existing symlink")
+	}
+}
+
+func TestDownloadCachePathRejectsGroupOrOtherAccessibleDir(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "ipfs")
+
+	if err := os.Mkdir(filepath.Join(dir, downloadCacheDirName), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := downloadCachePath(out, "archive.tar.gz"); err == nil {
+		t.Fatal("expected downloadCachePath to reject a pre-existing world-readable dir")
+	}
+}
+
+func TestLockDownloadExcludesConcurrentHolders(t *testing.T) {
+	arcPath := filepath.Join(t.TempDir(), "archive.tar.gz")
+
+	unlock, err := lockDownload(context.Background(), arcPath)
+	if err != nil {
+		t.Fatalf("lockDownload failed: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := lockDownload(ctx, arcPath); err == nil {
+		t.Fatal("expected a second lockDownload for the same path to block until ctx expires")
+	}
+
+	unlock()
+
+	unlock2, err := lockDownload(context.Background(), arcPath)
+	if err != nil {
+		t.Fatalf("expected lockDownload to succeed once the lock is released, got %s", err)
+	}
+	unlock2()
+}
+
+func TestLockDownloadReclaimsStaleLock(t *testing.T) {
+	arcPath := filepath.Join(t.TempDir(), "archive.tar.gz")
+	lockPath := arcPath + ".lock"
+
+	if err := ioutil.WriteFile(lockPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-staleLockAge * 2)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	unlock, err := lockDownload(ctx, arcPath)
+	if err != nil {
+		t.Fatalf("expected a stale lock to be reclaimed, got %s", err)
+	}
+	unlock()
+}
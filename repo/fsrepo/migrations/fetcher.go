@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"context"
+	"io"
+)
+
+// Fetcher knows how to fetch the bytes at a given distribution path,
+// writing them to the supplied io.Writer as they are retrieved.
+//
+// Implementations are free to fetch over HTTP, over a local ipfs daemon,
+// or by trying a sequence of other Fetchers.  Passing a Fetcher into
+// FetchBinary, DistVersions, and LatestDistVersion lets callers control
+// exactly how migration data is retrieved, e.g. to inject a mock for
+// tests, to force an offline-only path, or to combine multiple sources.
+type Fetcher interface {
+	// Fetch attempts to fetch the file at the given distribution path,
+	// writing its contents to out as they are retrieved.
+	Fetch(ctx context.Context, distPath string, out io.Writer) error
+
+	// Length returns the size, in bytes, of the most recently fetched
+	// file, or -1 if the size is not known.  Intended for progress
+	// reporting around Fetch.
+	Length() int64
+
+	// SetProgress registers a callback that is invoked periodically
+	// while Fetch is downloading, reporting its progress.  Pass nil to
+	// stop reporting progress.
+	SetProgress(p Progress)
+
+	// Close releases any resources held by the fetcher, such as a
+	// connection to a local ipfs daemon.
+	Close() error
+}
+
+// TransientError wraps a Fetch error that is likely to succeed if retried
+// later, such as a network failure or a server error, as opposed to a
+// permanent failure like a checksum mismatch or a malformed response.
+// FetchBinary uses this distinction to decide whether a partially
+// downloaded archive is worth keeping around for a later call to resume,
+// or should be discarded.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,401 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultUserAgent = "go-ipfs"
+
+const (
+	// defaultRequestTimeout bounds a single HTTP request, separate from
+	// the overall fetchSizeLimit on the amount of data read.
+	defaultRequestTimeout = 60 * time.Second
+
+	// defaultMaxRetries is the number of times a request is retried, with
+	// backoff, after a transient network error or 5xx response.
+	defaultMaxRetries = 4
+
+	backoffBase = 250 * time.Millisecond
+	backoffMax  = 10 * time.Second
+)
+
+// resumableWriter is the subset of *os.File that fetchResumable needs in
+// order to write a download directly to its final destination: it finds
+// how much of a previous attempt is already on disk by seeking to the end,
+// and discards it with Truncate if a retry turns out not to be resumable.
+// Satisfied by *os.File; a plain io.Writer such as a bytes.Buffer is not
+// resumable and falls back to fetchBuffered instead.
+type resumableWriter interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// HttpFetcher fetches files over HTTP, such as from an ipfs gateway.  It
+// can be given more than one gateway, in which case it round-robins
+// across them and fails over to the next gateway in the list if one
+// errors, so that operators can point migrations at their own gateway or
+// a list of mirrors without patching code.
+//
+// Requests that fail with a transient network error or 5xx response are
+// retried, with exponential backoff and jitter, up to the number of times
+// set with SetMaxRetries (defaultMaxRetries unless changed). If
+// the server supports range requests, a retry resumes from the point the
+// previous attempt left off instead of starting over. When out is a
+// resumableWriter (as FetchBinary's archive file is), that resume point is
+// on disk, so it survives across separate Fetch calls too, not just across
+// retries within one call.
+type HttpFetcher struct {
+	gateways   []string
+	userAgent  string
+	limit      int64
+	length     int64
+	timeout    time.Duration
+	maxRetries int
+	progress   Progress
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewHttpFetcher creates a new HttpFetcher that fetches from the given
+// gateways, trying them in round-robin order and failing over to the next
+// one on error.  If gateways is empty, the default gatewayURL is used.  If
+// userAgent is empty, a reasonable default is used.  A fetchLimit of 0
+// means use the default fetchSizeLimit.
+func NewHttpFetcher(gateways []string, userAgent string, fetchLimit int64) *HttpFetcher {
+	if len(gateways) == 0 {
+		gateways = []string{gatewayURL}
+	}
+	if len(userAgent) == 0 {
+		userAgent = defaultUserAgent
+	}
+	if fetchLimit == 0 {
+		fetchLimit = fetchSizeLimit
+	}
+
+	return &HttpFetcher{
+		gateways:   gateways,
+		userAgent:  userAgent,
+		limit:      fetchLimit,
+		length:     -1,
+		timeout:    defaultRequestTimeout,
+		maxRetries: defaultMaxRetries,
+	}
+}
+
+// SetTimeout sets the timeout applied to each individual HTTP request. It
+// does not bound the overall time spent across retries.
+func (f *HttpFetcher) SetTimeout(timeout time.Duration) {
+	f.timeout = timeout
+}
+
+// SetMaxRetries sets the number of times a request is retried after a
+// transient network error or 5xx response.
+func (f *HttpFetcher) SetMaxRetries(maxRetries int) {
+	f.maxRetries = maxRetries
+}
+
+// SetProgress registers a callback that is invoked periodically while
+// Fetch is downloading, reporting its progress.
+func (f *HttpFetcher) SetProgress(p Progress) {
+	f.progress = p
+}
+
+// Fetch attempts to fetch the file at the given ipfs path, starting from
+// the next gateway in round-robin order and failing over to the remaining
+// gateways, in order, if one returns an error.
+//
+// If out is a resumableWriter (such as the *os.File FetchBinary downloads
+// into), the response is streamed directly to it and a retry resumes from
+// however much is already on disk. Otherwise out is filled from an
+// in-memory buffer, which also supports resuming a retry but not across
+// separate Fetch calls; this fallback exists for callers like
+// DistVersions that fetch small files into a bytes.Buffer.
+func (f *HttpFetcher) Fetch(ctx context.Context, ipfsPath string, out io.Writer) error {
+	f.mu.Lock()
+	start := f.next
+	f.next = (f.next + 1) % len(f.gateways)
+	f.mu.Unlock()
+
+	rw, resumable := out.(resumableWriter)
+
+	var err error
+	for i := 0; i < len(f.gateways); i++ {
+		gateway := f.gateways[(start+i)%len(f.gateways)]
+
+		if resumable {
+			err = f.fetchResumable(ctx, gateway, ipfsPath, rw)
+		} else {
+			err = f.fetchBuffered(ctx, gateway, ipfsPath, out)
+		}
+		if err == nil {
+			return nil
+		}
+		log.Printf("failed to fetch from gateway %s: %s", gateway, err)
+	}
+	return err
+}
+
+// fetchResumable fetches ipfsPath from gateway directly into out, retrying
+// transient errors with backoff. out already holding data from a previous,
+// interrupted attempt is treated as a resume point: the request picks up
+// from the end of out, and only falls back to restarting from the
+// beginning if the gateway doesn't honor the Range request.
+func (f *HttpFetcher) fetchResumable(ctx context.Context, gateway, ipfsPath string, out resumableWriter) error {
+	url := gateway + ipfsPath
+
+	written, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	var etag string
+	// If out already holds bytes, from a previous call that was
+	// interrupted, optimistically assume the server will honor a Range
+	// request for the rest; requestOnceResumable falls back to
+	// truncating and restarting if it guessed wrong.
+	resumable := written > 0
+	var lastErr error
+
+	for attempt := 0; attempt <= f.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := backoffSleep(ctx, attempt); err != nil {
+				// out already holds a valid, resumable partial download;
+				// classify this as transient so the caller preserves it
+				// instead of discarding it on a Ctrl-C or deadline.
+				return &TransientError{Err: err}
+			}
+		}
+
+		n, retryable, err := f.requestOnceResumable(ctx, url, out, written, etag, resumable, &resumable, &etag)
+		written = n
+		if err == nil {
+			f.length = written
+			return nil
+		}
+		if retryable {
+			lastErr = &TransientError{Err: err}
+		} else {
+			lastErr = err
+		}
+		if !retryable {
+			return lastErr
+		}
+	}
+
+	return lastErr
+}
+
+// requestOnceResumable performs a single HTTP request for url, resuming
+// from writtenSoFar bytes already in out if resumable, and streams the
+// response body directly into out. It returns the number of bytes now in
+// out and whether the caller should retry on error.
+func (f *HttpFetcher) requestOnceResumable(ctx context.Context, url string, out resumableWriter, writtenSoFar int64, etag string, resumable bool, outResumable *bool, outEtag *string) (int64, bool, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return writtenSoFar, false, fmt.Errorf("http.NewRequest error: %s", err)
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	if writtenSoFar > 0 && resumable {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", writtenSoFar))
+		if etag != "" {
+			req.Header.Set("If-Range", etag)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Transient network error: retry.
+		return writtenSoFar, true, fmt.Errorf("http.DefaultClient.Do error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return writtenSoFar, true, fmt.Errorf("GET %s error: %s", url, resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		mes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return writtenSoFar, false, fmt.Errorf("error reading error body: %s", err)
+		}
+		return writtenSoFar, false, fmt.Errorf("GET %s error: %s: %s", url, resp.Status, string(mes))
+	}
+
+	resumed := writtenSoFar > 0 && resp.StatusCode == http.StatusPartialContent
+	if !resumed {
+		if err := out.Truncate(0); err != nil {
+			return 0, false, err
+		}
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return 0, false, err
+		}
+		writtenSoFar = 0
+	}
+	*outResumable = resp.Header.Get("Accept-Ranges") == "bytes"
+	*outEtag = resp.Header.Get("ETag")
+
+	total := resp.ContentLength
+	if resumed && total >= 0 {
+		total += writtenSoFar
+	}
+
+	pw := newProgressWriter(out, total, "http:"+url, f.progress)
+	rc := newLimitReadCloser(resp.Body, f.limit)
+	n, err := io.Copy(pw, rc)
+	pw.finish()
+	written := writtenSoFar + n
+	if err != nil {
+		// A network error mid-transfer is transient; resume on retry if
+		// the server indicated it supports range requests.
+		return written, true, err
+	}
+
+	return written, false, nil
+}
+
+// fetchBuffered fetches ipfsPath from gateway into out, retrying transient
+// errors with backoff. Unlike fetchResumable, it does not stream directly
+// to out: out may not support seeking (e.g. a bytes.Buffer), so the
+// response is accumulated in memory and only copied to out once the whole
+// file has been retrieved, guaranteeing out never sees a gateway's output
+// restart partway through. Used for small, non-file destinations such as
+// the versions listing fetched by DistVersions.
+func (f *HttpFetcher) fetchBuffered(ctx context.Context, gateway, ipfsPath string, out io.Writer) error {
+	url := gateway + ipfsPath
+
+	var partial bytes.Buffer
+	var etag string
+	var resumable bool
+	var lastErr error
+
+	for attempt := 0; attempt <= f.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := backoffSleep(ctx, attempt); err != nil {
+				return err
+			}
+		}
+
+		retryable, err := f.requestOnceBuffered(ctx, url, &partial, etag, resumable, &resumable, &etag)
+		if err == nil {
+			f.length = int64(partial.Len())
+			_, err = io.Copy(out, &partial)
+			return err
+		}
+		if retryable {
+			lastErr = &TransientError{Err: err}
+		} else {
+			lastErr = err
+		}
+		if !retryable {
+			return lastErr
+		}
+	}
+
+	return lastErr
+}
+
+// requestOnceBuffered performs a single HTTP request for url, resuming from
+// the end of partial if resumable, and appends the response body to
+// partial through a progress-reporting wrapper. It returns whether the
+// caller should retry on error.
+func (f *HttpFetcher) requestOnceBuffered(ctx context.Context, url string, partial *bytes.Buffer, etag string, resumable bool, outResumable *bool, outEtag *string) (bool, error) {
+	writtenSoFar := int64(partial.Len())
+
+	reqCtx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("http.NewRequest error: %s", err)
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	if writtenSoFar > 0 && resumable {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", writtenSoFar))
+		if etag != "" {
+			req.Header.Set("If-Range", etag)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("http.DefaultClient.Do error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return true, fmt.Errorf("GET %s error: %s", url, resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		mes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return false, fmt.Errorf("error reading error body: %s", err)
+		}
+		return false, fmt.Errorf("GET %s error: %s: %s", url, resp.Status, string(mes))
+	}
+
+	resumed := writtenSoFar > 0 && resp.StatusCode == http.StatusPartialContent
+	if !resumed {
+		partial.Reset()
+	}
+	*outResumable = resp.Header.Get("Accept-Ranges") == "bytes"
+	*outEtag = resp.Header.Get("ETag")
+
+	total := resp.ContentLength
+	if resumed && total >= 0 {
+		total += writtenSoFar
+	}
+
+	pw := newProgressWriter(partial, total, "http:"+url, f.progress)
+	rc := newLimitReadCloser(resp.Body, f.limit)
+	_, err = io.Copy(pw, rc)
+	pw.finish()
+	if err != nil {
+		return true, err
+	}
+
+	return false, nil
+}
+
+// backoffSleep waits an exponentially increasing, jittered amount of time
+// before the given retry attempt, or returns ctx's error if ctx is done
+// first.
+func backoffSleep(ctx context.Context, attempt int) error {
+	d := backoffBase * time.Duration(uint(1)<<uint(attempt-1))
+	if d > backoffMax {
+		d = backoffMax
+	}
+	d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Length returns the size, in bytes, of the most recently fetched file.
+func (f *HttpFetcher) Length() int64 {
+	return f.length
+}
+
+// Close is a no-op for HttpFetcher, which holds no persistent resources.
+func (f *HttpFetcher) Close() error {
+	return nil
+}
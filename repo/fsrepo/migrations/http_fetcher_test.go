@@ -0,0 +1,191 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func tempArchiveFile(t *testing.T) *os.File {
+	t.Helper()
+	f, err := ioutil.TempFile("", "http-fetcher-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	return f
+}
+
+func TestHttpFetcherStreamsDirectlyToResumableFile(t *testing.T) {
+	content := "hello, archive"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	f := NewHttpFetcher([]string{srv.URL}, "", 0)
+	out := tempArchiveFile(t)
+
+	if err := f.Fetch(context.Background(), "/archive", out); err != nil {
+		t.Fatalf("Fetch failed: %s", err)
+	}
+	if f.Length() != int64(len(content)) {
+		t.Fatalf("expected Length() %d, got %d", len(content), f.Length())
+	}
+
+	got, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Fatalf("expected file content %q, got %q", content, string(got))
+	}
+}
+
+func TestHttpFetcherResumesFromExistingFileContent(t *testing.T) {
+	full := "0123456789abcdef"
+	already := full[:8]
+
+	var sawRange int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Header.Get("Range") == fmt.Sprintf("bytes=%d-", len(already)) {
+			atomic.StoreInt32(&sawRange, 1)
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(full[len(already):]))
+			return
+		}
+		w.Write([]byte(full))
+	}))
+	defer srv.Close()
+
+	f := NewHttpFetcher([]string{srv.URL}, "", 0)
+	out := tempArchiveFile(t)
+	if _, err := out.WriteString(already); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Fetch(context.Background(), "/archive", out); err != nil {
+		t.Fatalf("Fetch failed: %s", err)
+	}
+	if atomic.LoadInt32(&sawRange) == 0 {
+		t.Fatal("expected fetcher to request the remaining bytes via Range")
+	}
+
+	got, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != full {
+		t.Fatalf("expected file content %q, got %q", full, string(got))
+	}
+}
+
+func TestHttpFetcherRestartsWhenServerIgnoresRange(t *testing.T) {
+	full := "0123456789abcdef"
+	already := "wrong data"
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No Accept-Ranges, no 206: the server does not support resume,
+		// so the fetcher must discard `already` and restart from 0.
+		w.Write([]byte(full))
+	}))
+	defer srv.Close()
+
+	f := NewHttpFetcher([]string{srv.URL}, "", 0)
+	out := tempArchiveFile(t)
+	if _, err := out.WriteString(already); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Fetch(context.Background(), "/archive", out); err != nil {
+		t.Fatalf("Fetch failed: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != full {
+		t.Fatalf("expected file content %q, got %q", full, string(got))
+	}
+}
+
+func TestHttpFetcherRetriesTransientServerError(t *testing.T) {
+	content := "retried archive"
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	f := NewHttpFetcher([]string{srv.URL}, "", 0)
+	f.SetMaxRetries(1)
+	out := tempArchiveFile(t)
+
+	if err := f.Fetch(context.Background(), "/archive", out); err != nil {
+		t.Fatalf("Fetch failed: %s", err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected exactly 2 requests, got %d", requests)
+	}
+
+	got, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Fatalf("expected file content %q, got %q", content, string(got))
+	}
+}
+
+func TestHttpFetcherDoesNotRetryClientError(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	f := NewHttpFetcher([]string{srv.URL}, "", 0)
+	f.SetMaxRetries(3)
+	out := tempArchiveFile(t)
+
+	if err := f.Fetch(context.Background(), "/archive", out); err == nil {
+		t.Fatal("expected Fetch to fail")
+	}
+	if requests != 1 {
+		t.Fatalf("expected a 404 not to be retried, got %d requests", requests)
+	}
+}
+
+func TestHttpFetcherExhaustedRetriesReturnTransientError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	f := NewHttpFetcher([]string{srv.URL}, "", 0)
+	f.SetMaxRetries(1)
+	out := tempArchiveFile(t)
+
+	err := f.Fetch(context.Background(), "/archive", out)
+	var transient *TransientError
+	if !errors.As(err, &transient) {
+		t.Fatalf("expected a *TransientError after exhausting retries, got %v", err)
+	}
+}
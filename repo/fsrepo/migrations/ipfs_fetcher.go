@@ -0,0 +1,92 @@
+package migrations
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	api "github.com/ipfs/go-ipfs-api"
+)
+
+// IpfsFetcher fetches files via a local ipfs daemon's API.
+type IpfsFetcher struct {
+	apiEndpoint string
+	timeout     time.Duration
+	limit       int64
+	length      int64
+	progress    Progress
+}
+
+// NewIpfsFetcher creates a new IpfsFetcher.  If apiEndpoint is empty, the
+// endpoint is located using ApiEndpoint.  A timeout of 0 means use the
+// default shellTimeOut, and a fetchLimit of 0 means use the default
+// fetchSizeLimit.
+func NewIpfsFetcher(apiEndpoint string, timeout time.Duration, fetchLimit int64) *IpfsFetcher {
+	if timeout == 0 {
+		timeout = shellTimeOut
+	}
+	if fetchLimit == 0 {
+		fetchLimit = fetchSizeLimit
+	}
+
+	return &IpfsFetcher{
+		apiEndpoint: apiEndpoint,
+		timeout:     timeout,
+		limit:       fetchLimit,
+		length:      -1,
+	}
+}
+
+// Fetch attempts to fetch the file at the given ipfs path using the local
+// ipfs daemon's API.
+func (f *IpfsFetcher) Fetch(ctx context.Context, ipfsPath string, out io.Writer) error {
+	apiEp := f.apiEndpoint
+	if apiEp == "" {
+		var err error
+		apiEp, err = ApiEndpoint("")
+		if err != nil {
+			return err
+		}
+	}
+
+	sh := api.NewShell(apiEp)
+	sh.SetTimeout(f.timeout)
+	if !sh.IsUp() {
+		return errors.New("ipfs api shell not up")
+	}
+
+	resp, err := sh.Request("cat", ipfsPath).Send(ctx)
+	if err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return resp.Error
+	}
+
+	rc := newLimitReadCloser(resp.Output, f.limit)
+	defer rc.Close()
+
+	pw := newProgressWriter(out, -1, "ipfs", f.progress)
+	n, err := io.Copy(pw, rc)
+	pw.finish()
+	f.length = n
+	return err
+}
+
+// Length returns the size, in bytes, of the most recently fetched file.
+func (f *IpfsFetcher) Length() int64 {
+	return f.length
+}
+
+// SetProgress registers a callback that is invoked periodically while
+// Fetch is downloading, reporting its progress.
+func (f *IpfsFetcher) SetProgress(p Progress) {
+	f.progress = p
+}
+
+// Close is a no-op for IpfsFetcher, which does not keep its shell open
+// between fetches.
+func (f *IpfsFetcher) Close() error {
+	return nil
+}
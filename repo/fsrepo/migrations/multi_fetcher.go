@@ -0,0 +1,93 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+)
+
+// MultiFetcher tries each of its fetchers in order, returning the result of
+// the first one that succeeds.  This lets a caller combine sources, e.g.
+// preferring a local ipfs daemon and falling back to an http gateway.
+type MultiFetcher struct {
+	fetchers []Fetcher
+	length   int64
+}
+
+// NewMultiFetcher creates a MultiFetcher that tries each of the given
+// fetchers, in order, until one succeeds.
+func NewMultiFetcher(fetchers ...Fetcher) *MultiFetcher {
+	return &MultiFetcher{
+		fetchers: fetchers,
+		length:   -1,
+	}
+}
+
+// Fetch tries each of the configured fetchers in turn, returning as soon as
+// one succeeds.
+//
+// If out is a resumableWriter, it is passed straight through to each
+// fetcher in turn, so that an HttpFetcher among them can resume a download
+// on disk across retries; out is truncated before falling over to the next
+// fetcher, so a failed fetcher can never leave bytes for the next one to
+// append to. Otherwise, out is not resumable (e.g. a bytes.Buffer), so
+// each attempt is buffered separately to the same effect.
+func (f *MultiFetcher) Fetch(ctx context.Context, ipfsPath string, out io.Writer) error {
+	if len(f.fetchers) == 0 {
+		return errors.New("no fetchers configured")
+	}
+
+	rw, resumable := out.(resumableWriter)
+
+	var err error
+	for _, fetcher := range f.fetchers {
+		if resumable {
+			err = fetcher.Fetch(ctx, ipfsPath, rw)
+			if err == nil {
+				f.length = fetcher.Length()
+				return nil
+			}
+			if _, serr := rw.Seek(0, io.SeekStart); serr == nil {
+				rw.Truncate(0)
+			}
+		} else {
+			var buf bytes.Buffer
+			err = fetcher.Fetch(ctx, ipfsPath, &buf)
+			if err == nil {
+				f.length = int64(buf.Len())
+				_, err = io.Copy(out, &buf)
+				return err
+			}
+		}
+		log.Printf("could not fetch with %T: %s", fetcher, err)
+	}
+	return err
+}
+
+// Length returns the size, in bytes, of the most recently fetched file.
+func (f *MultiFetcher) Length() int64 {
+	return f.length
+}
+
+// SetProgress registers a callback that is invoked periodically while one
+// of this MultiFetcher's fetchers is downloading, reporting its progress.
+// It is forwarded to every fetcher tried by this MultiFetcher.
+func (f *MultiFetcher) SetProgress(p Progress) {
+	for _, fetcher := range f.fetchers {
+		fetcher.SetProgress(p)
+	}
+}
+
+// Close closes all of the fetchers that this MultiFetcher tries, returning
+// the first error encountered, if any.
+func (f *MultiFetcher) Close() error {
+	var err error
+	for _, fetcher := range f.fetchers {
+		if cerr := fetcher.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,149 @@
+package migrations
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// mockFetcher is a Fetcher whose behavior is scripted by a test, used to
+// exercise callers of the Fetcher interface without a network.
+type mockFetcher struct {
+	data     string
+	err      error
+	progress Progress
+	closed   bool
+	calls    int
+}
+
+func (m *mockFetcher) Fetch(ctx context.Context, distPath string, out io.Writer) error {
+	m.calls++
+	if m.err != nil {
+		return m.err
+	}
+	_, err := io.Copy(out, bytes.NewBufferString(m.data))
+	return err
+}
+
+func (m *mockFetcher) Length() int64 {
+	return int64(len(m.data))
+}
+
+func (m *mockFetcher) SetProgress(p Progress) {
+	m.progress = p
+}
+
+func (m *mockFetcher) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestMultiFetcherFallsBackOnError(t *testing.T) {
+	bad := &mockFetcher{err: errors.New("boom")}
+	good := &mockFetcher{data: "hello"}
+	mf := NewMultiFetcher(bad, good)
+
+	var buf bytes.Buffer
+	if err := mf.Fetch(context.Background(), "/ipfs/foo", &buf); err != nil {
+		t.Fatalf("Fetch returned error: %s", err)
+	}
+	if buf.String() != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", buf.String())
+	}
+	if bad.calls != 1 || good.calls != 1 {
+		t.Fatalf("expected each fetcher to be tried once, got bad=%d good=%d", bad.calls, good.calls)
+	}
+}
+
+func TestMultiFetcherReturnsLastErrorWhenAllFail(t *testing.T) {
+	err1 := errors.New("first")
+	err2 := errors.New("second")
+	mf := NewMultiFetcher(&mockFetcher{err: err1}, &mockFetcher{err: err2})
+
+	var buf bytes.Buffer
+	err := mf.Fetch(context.Background(), "/ipfs/foo", &buf)
+	if !errors.Is(err, err2) {
+		t.Fatalf("expected final error to be %v, got %v", err2, err)
+	}
+}
+
+func TestMultiFetcherNoFetchersConfigured(t *testing.T) {
+	mf := NewMultiFetcher()
+	var buf bytes.Buffer
+	if err := mf.Fetch(context.Background(), "/ipfs/foo", &buf); err == nil {
+		t.Fatal("expected error when no fetchers are configured")
+	}
+}
+
+func TestMultiFetcherSetProgressForwardsToChildren(t *testing.T) {
+	a := &mockFetcher{data: "a"}
+	b := &mockFetcher{data: "b"}
+	mf := NewMultiFetcher(a, b)
+
+	var p Progress = func(ProgressEvent) {}
+	mf.SetProgress(p)
+
+	if a.progress == nil || b.progress == nil {
+		t.Fatal("expected SetProgress to be forwarded to every child fetcher")
+	}
+}
+
+// partialThenErrFetcher writes partial bytes directly to out, as a
+// real streaming Fetcher failing mid-transfer would, and then fails.
+type partialThenErrFetcher struct {
+	partial string
+	err     error
+}
+
+func (p *partialThenErrFetcher) Fetch(ctx context.Context, distPath string, out io.Writer) error {
+	if _, err := out.Write([]byte(p.partial)); err != nil {
+		return err
+	}
+	return p.err
+}
+
+func (p *partialThenErrFetcher) Length() int64        { return -1 }
+func (p *partialThenErrFetcher) SetProgress(Progress) {}
+func (p *partialThenErrFetcher) Close() error         { return nil }
+
+func TestMultiFetcherTruncatesResumableOutBetweenFetchers(t *testing.T) {
+	bad := &partialThenErrFetcher{partial: "garbage-from-failed-attempt", err: errors.New("boom")}
+	good := &mockFetcher{data: "good data"}
+	mf := NewMultiFetcher(bad, good)
+
+	tmp, err := ioutil.TempFile("", "multi-fetcher-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := mf.Fetch(context.Background(), "/ipfs/foo", tmp); err != nil {
+		t.Fatalf("Fetch returned error: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "good data" {
+		t.Fatalf("expected leftover bytes from the failed fetcher to be truncated, got %q", string(got))
+	}
+}
+
+func TestMultiFetcherCloseClosesAllChildren(t *testing.T) {
+	a := &mockFetcher{data: "a"}
+	b := &mockFetcher{data: "b"}
+	mf := NewMultiFetcher(a, b)
+
+	if err := mf.Close(); err != nil {
+		t.Fatalf("Close returned error: %s", err)
+	}
+	if !a.closed || !b.closed {
+		t.Fatal("expected Close to close every child fetcher")
+	}
+}
@@ -0,0 +1,99 @@
+package migrations
+
+import (
+	"io"
+	"time"
+)
+
+// progressReportInterval is the minimum time between calls to a Progress
+// callback while a fetch is in flight, so that callbacks driving a UI are
+// not flooded.
+const progressReportInterval = 200 * time.Millisecond
+
+// ProgressEvent describes the state of an in-progress fetch, reported to a
+// Progress callback.
+type ProgressEvent struct {
+	// Source identifies where the bytes are coming from: "http:" followed
+	// by the URL requested, "http-verified:" followed by the gateway URL,
+	// or "ipfs".
+	Source string
+	// Total is the size, in bytes, of the file being fetched, or -1 if
+	// not known.
+	Total int64
+	// Fetched is the number of bytes transferred so far.
+	Fetched int64
+	// Speed is the transfer rate, in bytes per second, averaged since the
+	// previous event.
+	Speed int64
+	// Elapsed is the time since the fetch began.
+	Elapsed time.Duration
+}
+
+// Progress is called periodically while a Fetcher is fetching a file, to
+// report its progress.
+type Progress func(ProgressEvent)
+
+// progressWriter wraps an io.Writer, calling a Progress callback as bytes
+// are written through it.
+type progressWriter struct {
+	out      io.Writer
+	total    int64
+	source   string
+	progress Progress
+
+	start     time.Time
+	written   int64
+	lastTime  time.Time
+	lastBytes int64
+}
+
+func newProgressWriter(out io.Writer, total int64, source string, progress Progress) *progressWriter {
+	now := time.Now()
+	return &progressWriter{
+		out:      out,
+		total:    total,
+		source:   source,
+		progress: progress,
+		start:    now,
+		lastTime: now,
+	}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.out.Write(p)
+	w.written += int64(n)
+
+	if w.progress != nil {
+		now := time.Now()
+		if since := now.Sub(w.lastTime); since >= progressReportInterval {
+			w.report(now, since)
+		}
+	}
+
+	return n, err
+}
+
+// finish reports a final progress event covering any bytes written since
+// the last report.  Callers should invoke this once after the last Write.
+func (w *progressWriter) finish() {
+	if w.progress != nil {
+		now := time.Now()
+		w.report(now, now.Sub(w.lastTime))
+	}
+}
+
+func (w *progressWriter) report(now time.Time, since time.Duration) {
+	var speed int64
+	if since > 0 {
+		speed = int64(float64(w.written-w.lastBytes) / since.Seconds())
+	}
+	w.progress(ProgressEvent{
+		Source:  w.source,
+		Total:   w.total,
+		Fetched: w.written,
+		Speed:   speed,
+		Elapsed: now.Sub(w.start),
+	})
+	w.lastTime = now
+	w.lastBytes = w.written
+}
@@ -0,0 +1,272 @@
+package migrations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	blockservice "github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	merkledag "github.com/ipfs/go-merkledag"
+	uio "github.com/ipfs/go-unixfs/io"
+	carv2 "github.com/ipld/go-car/v2"
+)
+
+// distCIDsEnvVar names the environment variable that, when set, points to a
+// JSON file of dist-path-to-CID overrides for VerifiedHttpFetcher.  See
+// loadDistCIDs.
+const distCIDsEnvVar = "KUBO_MIGRATION_CIDS"
+
+// carAcceptHeader and rawAcceptHeader are the trustless gateway media types
+// requested by VerifiedHttpFetcher, per IPIP-0288.
+const (
+	carAcceptHeader = "application/vnd.ipld.car"
+	rawAcceptHeader = "application/vnd.ipld.raw"
+)
+
+// ErrUnknownCID is returned when VerifiedHttpFetcher has no known CID to
+// verify a requested dist path against.
+var ErrUnknownCID = errors.New("no known CID for dist path; cannot verify")
+
+// ErrBlockHashMismatch is returned when a block fetched from the gateway
+// does not hash to the CID it claims to have.
+var ErrBlockHashMismatch = errors.New("block data does not match its CID")
+
+// distCIDs is the embedded mapping of "dist/version/archive-name" to the
+// CID that a trustless gateway is expected to serve for it.  It is
+// populated at release time, and can be extended or overridden without a
+// rebuild; see loadDistCIDs.
+var distCIDs = map[string]string{}
+
+// loadDistCIDs returns the effective dist-path-to-CID mapping: the embedded
+// distCIDs, with entries overridden first by overrideFile (if non-empty),
+// and then by the file named in the KUBO_MIGRATION_CIDS environment
+// variable, if set.  Both override files are JSON objects of the same
+// shape as distCIDs.
+func loadDistCIDs(overrideFile string) (map[string]string, error) {
+	out := make(map[string]string, len(distCIDs))
+	for k, v := range distCIDs {
+		out[k] = v
+	}
+
+	for _, file := range []string{overrideFile, os.Getenv(distCIDsEnvVar)} {
+		if file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read dist CID overrides %q: %w", file, err)
+		}
+		var overrides map[string]string
+		if err = json.Unmarshal(data, &overrides); err != nil {
+			return nil, fmt.Errorf("cannot parse dist CID overrides %q: %w", file, err)
+		}
+		for k, v := range overrides {
+			out[k] = v
+		}
+	}
+
+	return out, nil
+}
+
+// VerifiedHttpFetcher fetches files from a trustless IPFS gateway, verifying
+// every block received against a known CID instead of trusting TLS and the
+// server.  It is used the same way as HttpFetcher, but refuses to return
+// data that does not match the CID recorded for the requested dist path.
+type VerifiedHttpFetcher struct {
+	gateway   string
+	userAgent string
+	limit     int64
+	length    int64
+	cids      map[string]string
+	progress  Progress
+}
+
+// NewVerifiedHttpFetcher creates a new VerifiedHttpFetcher.  If gateway or
+// userAgent are empty, the same defaults as HttpFetcher are used.
+// cidOverrideFile, if non-empty, names a JSON file of dist-path-to-CID
+// overrides; see loadDistCIDs for how it combines with the embedded
+// defaults and the KUBO_MIGRATION_CIDS environment variable.
+func NewVerifiedHttpFetcher(gateway, userAgent, cidOverrideFile string, fetchLimit int64) (*VerifiedHttpFetcher, error) {
+	if len(gateway) == 0 {
+		gateway = gatewayURL
+	}
+	if len(userAgent) == 0 {
+		userAgent = defaultUserAgent
+	}
+	if fetchLimit == 0 {
+		fetchLimit = fetchSizeLimit
+	}
+
+	cids, err := loadDistCIDs(cidOverrideFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &VerifiedHttpFetcher{
+		gateway:   gateway,
+		userAgent: userAgent,
+		limit:     fetchLimit,
+		length:    -1,
+		cids:      cids,
+	}, nil
+}
+
+// Fetch retrieves ipfsPath from the configured gateway as a trustless
+// response, verifying every block against the CID recorded for ipfsPath
+// before any bytes are written to out.  The CID's own codec decides the
+// response format requested: a raw-codec CID (such as the single-block
+// "versions" file) is requested as application/vnd.ipld.raw, and anything
+// else (a UnixFS DAG, such as an archive) is requested as a CAR.
+func (f *VerifiedHttpFetcher) Fetch(ctx context.Context, ipfsPath string, out io.Writer) error {
+	rootStr, ok := f.cids[strings.TrimPrefix(ipfsPath, ipfsDistPath+"/")]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCID, ipfsPath)
+	}
+	root, err := cid.Decode(rootStr)
+	if err != nil {
+		return fmt.Errorf("invalid CID for %s: %w", ipfsPath, err)
+	}
+
+	raw := root.Prefix().Codec == cid.Raw
+
+	format := "car"
+	accept := carAcceptHeader
+	if raw {
+		format = "raw"
+		accept = rawAcceptHeader
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.gateway+ipfsPath+"?format="+format, nil)
+	if err != nil {
+		return fmt.Errorf("http.NewRequest error: %s", err)
+	}
+	req.Header.Set("User-Agent", f.userAgent)
+	req.Header.Set("Accept", accept)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("http.DefaultClient.Do error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		mes, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.limit))
+		if err != nil {
+			return fmt.Errorf("error reading error body: %s", err)
+		}
+		return fmt.Errorf("GET %s error: %s: %s", req.URL, resp.Status, string(mes))
+	}
+
+	body := newLimitReadCloser(resp.Body, f.limit)
+	defer body.Close()
+
+	// Nothing is written to out until every block has been verified, so
+	// the progress reported here jumps from 0 to done rather than
+	// tracking bytes as they stream in.
+	pw := newProgressWriter(out, resp.ContentLength, "http-verified:"+f.gateway, f.progress)
+
+	var n int64
+	if raw {
+		n, err = f.fetchRaw(root, body, pw)
+	} else {
+		n, err = f.fetchCAR(ctx, root, body, pw)
+	}
+	pw.finish()
+	f.length = n
+	return err
+}
+
+// fetchRaw verifies a single-block raw response against root and copies it
+// to out.
+func (f *VerifiedHttpFetcher) fetchRaw(root cid.Cid, body io.Reader, out io.Writer) (int64, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return 0, err
+	}
+	if err = verifyBlock(root, data); err != nil {
+		return 0, err
+	}
+	n, err := out.Write(data)
+	return int64(n), err
+}
+
+// fetchCAR reads a CAR stream, verifying every block against its claimed
+// CID as it arrives, then walks the UnixFS DAG rooted at root and copies
+// the decoded file contents to out.  No bytes are written to out until
+// every block has been read and verified.
+func (f *VerifiedHttpFetcher) fetchCAR(ctx context.Context, root cid.Cid, body io.Reader, out io.Writer) (int64, error) {
+	br, err := carv2.NewBlockReader(body)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CAR stream: %w", err)
+	}
+
+	bs := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("reading CAR block: %w", err)
+		}
+		if err = verifyBlock(blk.Cid(), blk.RawData()); err != nil {
+			return 0, fmt.Errorf("%w: %s", err, blk.Cid())
+		}
+		if err = bs.Put(blk); err != nil {
+			return 0, err
+		}
+	}
+
+	dagServ := merkledag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+	rootNode, err := dagServ.Get(ctx, root)
+	if err != nil {
+		return 0, fmt.Errorf("root block not found in CAR: %w", err)
+	}
+
+	dr, err := uio.NewDagReader(ctx, rootNode, dagServ)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(out, dr)
+}
+
+// verifyBlock returns ErrBlockHashMismatch unless data hashes, using the
+// hash function named by c, to c itself.
+func verifyBlock(c cid.Cid, data []byte) error {
+	expected, err := c.Prefix().Sum(data)
+	if err != nil {
+		return err
+	}
+	if !expected.Equals(c) {
+		return ErrBlockHashMismatch
+	}
+	return nil
+}
+
+// Length returns the size, in bytes, of the most recently fetched file.
+func (f *VerifiedHttpFetcher) Length() int64 {
+	return f.length
+}
+
+// SetProgress registers a callback that is invoked periodically while
+// Fetch is downloading, reporting its progress.
+func (f *VerifiedHttpFetcher) SetProgress(p Progress) {
+	f.progress = p
+}
+
+// Close is a no-op for VerifiedHttpFetcher, which holds no persistent
+// resources.
+func (f *VerifiedHttpFetcher) Close() error {
+	return nil
+}
@@ -0,0 +1,83 @@
+package migrations
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	cid "github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// rawCIDFor returns the CIDv1/raw CID for data, i.e. what a trustless
+// gateway is expected to serve it under.
+func rawCIDFor(t *testing.T, data []byte) cid.Cid {
+	t.Helper()
+	prefix := cid.Prefix{
+		Version:  1,
+		Codec:    cid.Raw,
+		MhType:   mh.SHA2_256,
+		MhLength: -1,
+	}
+	c, err := prefix.Sum(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestVerifyBlockAcceptsMatchingData(t *testing.T) {
+	data := []byte("block contents")
+	c := rawCIDFor(t, data)
+
+	if err := verifyBlock(c, data); err != nil {
+		t.Fatalf("expected matching block to verify, got %s", err)
+	}
+}
+
+func TestVerifyBlockRejectsTamperedData(t *testing.T) {
+	c := rawCIDFor(t, []byte("original contents"))
+
+	err := verifyBlock(c, []byte("tampered contents"))
+	if !errors.Is(err, ErrBlockHashMismatch) {
+		t.Fatalf("expected ErrBlockHashMismatch, got %v", err)
+	}
+}
+
+func TestFetchRawAcceptsMatchingData(t *testing.T) {
+	data := []byte("the versions file")
+	c := rawCIDFor(t, data)
+
+	f := &VerifiedHttpFetcher{}
+	var out bytes.Buffer
+	n, err := f.fetchRaw(c, bytes.NewReader(data), &out)
+	if err != nil {
+		t.Fatalf("expected fetchRaw to succeed, got %s", err)
+	}
+	if n != int64(len(data)) || out.String() != string(data) {
+		t.Fatalf("expected %q (%d bytes), got %q (%d bytes)", data, len(data), out.String(), n)
+	}
+}
+
+func TestFetchRawRejectsTamperedData(t *testing.T) {
+	c := rawCIDFor(t, []byte("expected contents"))
+
+	f := &VerifiedHttpFetcher{}
+	var out bytes.Buffer
+	_, err := f.fetchRaw(c, bytes.NewReader([]byte("substituted contents")), &out)
+	if !errors.Is(err, ErrBlockHashMismatch) {
+		t.Fatalf("expected ErrBlockHashMismatch, got %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatal("expected nothing written to out when block verification fails")
+	}
+}
+
+func TestVerifiedHttpFetcherUnknownCIDIsAnError(t *testing.T) {
+	f := &VerifiedHttpFetcher{cids: map[string]string{}}
+	var out bytes.Buffer
+	err := f.Fetch(nil, "/ipfs/not-tracked", &out) //nolint:staticcheck // nil ctx: request is never made
+	if !errors.Is(err, ErrUnknownCID) {
+		t.Fatalf("expected ErrUnknownCID, got %v", err)
+	}
+}
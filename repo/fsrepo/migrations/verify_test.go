@@ -0,0 +1,200 @@
+package migrations
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// writeTempFile writes data to a new temp file and returns its path,
+// removing it when the test completes.
+func writeTempFile(t *testing.T, data string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "verify-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return f.Name()
+}
+
+// mapFetcher serves fixed content for specific ipfs paths, used to stand in
+// for the checksum/signature sidecar files that verifyChecksum/
+// verifySignature fetch alongside an archive.  A path with no entry in
+// content fails to fetch, as if the sidecar file did not exist.
+type mapFetcher struct {
+	content map[string][]byte
+}
+
+func (m *mapFetcher) Fetch(ctx context.Context, distPath string, out io.Writer) error {
+	data, ok := m.content[distPath]
+	if !ok {
+		return fmt.Errorf("not found: %s", distPath)
+	}
+	_, err := out.Write(data)
+	return err
+}
+
+func (m *mapFetcher) Length() int64 { return -1 }
+
+func (m *mapFetcher) SetProgress(Progress) {}
+
+func (m *mapFetcher) Close() error { return nil }
+
+func TestVerifyChecksumEmptyFileIsAnErrorNotAPanic(t *testing.T) {
+	data := []byte("archive bytes")
+	fetcher := &mapFetcher{content: map[string][]byte{
+		"/archive.sha512": []byte("   \n"),
+	}}
+
+	err := verifyChecksum(context.Background(), fetcher, "/archive", data, VerifyOptions{})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestVerifyChecksumMatch(t *testing.T) {
+	data := []byte("archive bytes")
+	sum := sha512.Sum512(data)
+	fetcher := &mapFetcher{content: map[string][]byte{
+		"/archive.sha512": []byte(hex.EncodeToString(sum[:]) + "  archive\n"),
+	}}
+
+	if err := verifyChecksum(context.Background(), fetcher, "/archive", data, VerifyOptions{}); err != nil {
+		t.Fatalf("expected checksum to verify, got %s", err)
+	}
+}
+
+func TestVerifyChecksumMismatch(t *testing.T) {
+	data := []byte("archive bytes")
+	fetcher := &mapFetcher{content: map[string][]byte{
+		"/archive.sha512": []byte(hex.EncodeToString(make([]byte, sha512.Size)) + "\n"),
+	}}
+
+	err := verifyChecksum(context.Background(), fetcher, "/archive", data, VerifyOptions{})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+func TestVerifyChecksumMissingIsToleratedByDefault(t *testing.T) {
+	fetcher := &mapFetcher{content: map[string][]byte{}}
+
+	err := verifyChecksum(context.Background(), fetcher, "/archive", []byte("data"), VerifyOptions{})
+	if err != nil {
+		t.Fatalf("expected missing checksum to be tolerated, got %s", err)
+	}
+}
+
+func TestVerifyChecksumMissingFailsWhenRequired(t *testing.T) {
+	fetcher := &mapFetcher{content: map[string][]byte{}}
+
+	err := verifyChecksum(context.Background(), fetcher, "/archive", []byte("data"), VerifyOptions{RequireChecksum: true})
+	if err == nil {
+		t.Fatal("expected missing checksum to fail when RequireChecksum is set")
+	}
+}
+
+func TestVerifySignatureSkippedWhenNoTrustedKeys(t *testing.T) {
+	old := trustedKeys
+	trustedKeys = nil
+	defer func() { trustedKeys = old }()
+
+	// No fetch should even be attempted: a fetcher with nothing mapped
+	// must not cause a failure here.
+	fetcher := &mapFetcher{content: map[string][]byte{}}
+
+	err := verifySignature(context.Background(), fetcher, "/archive", []byte("data"), VerifyOptions{RequireSignature: true})
+	if err != nil {
+		t.Fatalf("expected signature check to be skipped with no trusted keys, got %s", err)
+	}
+}
+
+func TestVerifySignatureValid(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := trustedKeys
+	trustedKeys = []string{base64.StdEncoding.EncodeToString(pub)}
+	defer func() { trustedKeys = old }()
+
+	data := []byte("archive bytes")
+	sig := ed25519.Sign(priv, data)
+	fetcher := &mapFetcher{content: map[string][]byte{
+		"/archive" + sigSuffix: []byte(base64.StdEncoding.EncodeToString(sig)),
+	}}
+
+	if err := verifySignature(context.Background(), fetcher, "/archive", data, VerifyOptions{}); err != nil {
+		t.Fatalf("expected valid signature to verify, got %s", err)
+	}
+}
+
+func TestVerifySignatureTampered(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := trustedKeys
+	trustedKeys = []string{base64.StdEncoding.EncodeToString(pub)}
+	defer func() { trustedKeys = old }()
+
+	sig := ed25519.Sign(priv, []byte("archive bytes"))
+	fetcher := &mapFetcher{content: map[string][]byte{
+		"/archive" + sigSuffix: []byte(base64.StdEncoding.EncodeToString(sig)),
+	}}
+
+	err = verifySignature(context.Background(), fetcher, "/archive", []byte("tampered bytes"), VerifyOptions{})
+	if !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("expected ErrSignatureInvalid, got %v", err)
+	}
+}
+
+func TestVerifySignatureMissingToleratedUnlessRequired(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := trustedKeys
+	trustedKeys = []string{base64.StdEncoding.EncodeToString(pub)}
+	defer func() { trustedKeys = old }()
+
+	fetcher := &mapFetcher{content: map[string][]byte{}}
+
+	if err := verifySignature(context.Background(), fetcher, "/archive", []byte("data"), VerifyOptions{}); err != nil {
+		t.Fatalf("expected missing signature to be tolerated, got %s", err)
+	}
+
+	err = verifySignature(context.Background(), fetcher, "/archive", []byte("data"), VerifyOptions{RequireSignature: true})
+	if err == nil {
+		t.Fatal("expected missing signature to fail when RequireSignature is set")
+	}
+}
+
+func TestVerifyArchiveSkipVerify(t *testing.T) {
+	// A fetcher that always fails must not be consulted at all when
+	// SkipVerify is set.
+	fetcher := &mapFetcher{content: map[string][]byte{}}
+
+	arcPath := writeTempFile(t, "unchecked archive bytes")
+
+	data, err := verifyArchive(context.Background(), fetcher, "/archive", arcPath, VerifyOptions{SkipVerify: true, RequireChecksum: true})
+	if err != nil {
+		t.Fatalf("expected SkipVerify to bypass verification entirely, got %s", err)
+	}
+	if string(data) != "unchecked archive bytes" {
+		t.Fatalf("expected verifyArchive to return the file's bytes, got %q", data)
+	}
+}
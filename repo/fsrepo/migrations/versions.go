@@ -2,6 +2,7 @@ package migrations
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -16,8 +17,8 @@ const distVersions = "versions"
 
 // LatestDistVersion returns the latest version, of the specified distribution,
 // that is available on the distribution site.
-func LatestDistVersion(ctx context.Context, dist string) (string, error) {
-	vs, err := DistVersions(ctx, dist, false)
+func LatestDistVersion(ctx context.Context, fetcher Fetcher, dist string) (string, error) {
+	vs, err := DistVersions(ctx, fetcher, dist, false)
 	if err != nil {
 		return "", err
 	}
@@ -34,17 +35,17 @@ func LatestDistVersion(ctx context.Context, dist string) (string, error) {
 // DistVersions returns all versions of the specified distribution, that are
 // available on the distriburion site.  List is in ascending order, unless
 // sortDesc is true.
-func DistVersions(ctx context.Context, dist string, sortDesc bool) ([]string, error) {
-	rc, err := fetch(ctx, path.Join(ipfsDistPath, dist, distVersions))
+func DistVersions(ctx context.Context, fetcher Fetcher, dist string, sortDesc bool) ([]string, error) {
+	var buf bytes.Buffer
+	err := fetcher.Fetch(ctx, path.Join(ipfsDistPath, dist, distVersions), &buf)
 	if err != nil {
 		return nil, err
 	}
-	defer rc.Close()
 
 	prefix := "v"
 	var vers []*semver.Version
 
-	scan := bufio.NewScanner(rc)
+	scan := bufio.NewScanner(&buf)
 	for scan.Scan() {
 		ver, err := semver.NewVersion(strings.TrimLeft(scan.Text(), prefix))
 		if err != nil {